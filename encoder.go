@@ -0,0 +1,64 @@
+package main
+
+import (
+	"flag"
+	"github.com/uttamgandhi24/whisper-go/whisper"
+	"math"
+	"strconv"
+)
+
+// Encoder renders one decoded whisper point in a given backend's wire
+// format. Line-based encoders return a single line to be written through
+// the existing per-rate sinks (file or InfluxDB HTTP); the Prometheus
+// remote-write encoder instead buffers the sample itself and returns an
+// empty string, since remote_write ships whole batched WriteRequests
+// rather than lines.
+type Encoder interface {
+	Encode(migration *MigrationData, point whisper.Point, rate uint32) string
+}
+
+var outputEncoder = flag.String("output", "influx", "Output format: influx (InfluxDB line protocol), graphite (Graphite plaintext) or promrw (Prometheus remote_write).")
+
+// SelectEncoder builds the Encoder named by -output.
+func SelectEncoder() Encoder {
+	switch *outputEncoder {
+	case "graphite":
+		return GraphiteEncoder{}
+	case "promrw":
+		return &PrometheusRemoteWriteEncoder{}
+	default:
+		return InfluxLineEncoder{ApplyFactor: true}
+	}
+}
+
+// InfluxLineEncoder renders points as InfluxDB line protocol, the
+// historical behavior of this tool. ApplyFactor preserves the existing
+// quirk of multiplying the value by the retention rate before writing it.
+type InfluxLineEncoder struct {
+	ApplyFactor bool
+}
+
+func (e InfluxLineEncoder) Encode(migration *MigrationData, point whisper.Point, rate uint32) string {
+	factor := float64(1)
+	if e.ApplyFactor {
+		factor = float64(rate)
+	}
+
+	var line string
+	line += migration.measurement
+	line += migration.tags
+	line += " "
+	line += migration.field + "=" + strconv.FormatFloat(math.Ceil(point.Value*factor), 'f', -1, 64)
+	line += " "
+	line += strconv.FormatInt(int64(point.Timestamp), 10)
+	return line
+}
+
+// GraphiteEncoder renders points as Graphite plaintext
+// ("<metric> <value> <timestamp>"), useful for round-tripping whisper data
+// back into a Graphite-compatible store.
+type GraphiteEncoder struct{}
+
+func (e GraphiteEncoder) Encode(migration *MigrationData, point whisper.Point, rate uint32) string {
+	return migration.measurement + " " + strconv.FormatFloat(point.Value, 'f', -1, 64) + " " + strconv.FormatInt(int64(point.Timestamp), 10)
+}
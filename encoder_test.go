@@ -0,0 +1,67 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/uttamgandhi24/whisper-go/whisper"
+)
+
+func TestSanitizeMetricName(t *testing.T) {
+	cases := []struct{ in, want string }{
+		{"server.cpu.load", "server_cpu_load"},
+		{"1server", "_1server"},
+		{"already_valid:name", "already_valid:name"},
+		{"", ""},
+	}
+	for _, c := range cases {
+		if got := sanitizeMetricName(c.in); got != c.want {
+			t.Errorf("sanitizeMetricName(%q) = %q, want %q", c.in, got, c.want)
+		}
+	}
+}
+
+func TestInfluxLineEncoderAppliesFactor(t *testing.T) {
+	migration := &MigrationData{measurement: "cpu", tags: ",host=a", field: "value"}
+	point := whisper.Point{Value: 2, Timestamp: 1000}
+
+	line := InfluxLineEncoder{ApplyFactor: true}.Encode(migration, point, 60)
+	want := "cpu,host=a value=120 1000"
+	if line != want {
+		t.Errorf("got %q, want %q", line, want)
+	}
+
+	line = InfluxLineEncoder{ApplyFactor: false}.Encode(migration, point, 60)
+	want = "cpu,host=a value=2 1000"
+	if line != want {
+		t.Errorf("got %q, want %q", line, want)
+	}
+}
+
+func TestGraphiteEncoder(t *testing.T) {
+	migration := &MigrationData{measurement: "cpu.load"}
+	point := whisper.Point{Value: 1.5, Timestamp: 1000}
+
+	line := GraphiteEncoder{}.Encode(migration, point, 60)
+	want := "cpu.load 1.5 1000"
+	if line != want {
+		t.Errorf("got %q, want %q", line, want)
+	}
+}
+
+func TestPrometheusRemoteWriteEncoderBuffersWithoutReturningALine(t *testing.T) {
+	e := &PrometheusRemoteWriteEncoder{}
+	migration := &MigrationData{measurement: "cpu", field: "load", tags: ",host=a"}
+	point := whisper.Point{Value: 1, Timestamp: 1000}
+
+	line := e.Encode(migration, point, 60)
+	if line != "" {
+		t.Errorf("expected promrw's Encode to return \"\", got %q", line)
+	}
+
+	e.mu.Lock()
+	n := len(e.series)
+	e.mu.Unlock()
+	if n != 1 {
+		t.Errorf("expected the sample to be buffered, got %d series", n)
+	}
+}
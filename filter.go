@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// SelectFilter decides whether a file or directory, given as the path
+// relative to -wsp-path, should be walked into (directories) or migrated
+// (wsp files). Returning false for a directory prunes the whole subtree
+// before any wsp file underneath it is opened.
+type SelectFilter func(relPath string, fi os.FileInfo) bool
+
+// stringList is a repeatable string flag, e.g. -include foo -include bar.
+type stringList []string
+
+func (s *stringList) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringList) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+var (
+	includePatterns stringList
+	excludePatterns stringList
+	filterFile      = flag.String("filter-file", "", "File with one include/exclude glob pattern per line, prefix with ! to negate (gitignore-style). Applied after -include/-exclude.")
+)
+
+func init() {
+	flag.Var(&includePatterns, "include", "Glob pattern (relative to -wsp-path) a file must match to be migrated. Repeatable; if any are given, a file must match at least one.")
+	flag.Var(&excludePatterns, "exclude", "Glob pattern (relative to -wsp-path) that prunes a matching file or directory from the migration. Repeatable.")
+}
+
+// filterRule is one line of -filter-file.
+type filterRule struct {
+	pattern string
+	include bool // true when the line was prefixed with "!"
+}
+
+// BuildSelectFilter assembles the SelectFilter used by listWspFiles from
+// -include, -exclude and -filter-file.
+func BuildSelectFilter() SelectFilter {
+	rules := loadFilterFile(*filterFile)
+
+	return func(relPath string, fi os.FileInfo) bool {
+		if len(includePatterns) > 0 && !fi.IsDir() {
+			included := false
+			for _, pattern := range includePatterns {
+				if matchGlob(pattern, relPath) {
+					included = true
+					break
+				}
+			}
+			if !included {
+				return false
+			}
+		}
+
+		for _, pattern := range excludePatterns {
+			if matchGlob(pattern, relPath) {
+				return false
+			}
+		}
+
+		// Filter-file rules apply in order; the last matching rule wins,
+		// same as .gitignore.
+		keep := true
+		for _, rule := range rules {
+			if matchGlob(rule.pattern, relPath) {
+				keep = rule.include
+			}
+		}
+
+		return keep
+	}
+}
+
+// loadFilterFile reads -filter-file, one glob pattern per line. A line
+// starting with "!" negates it, re-including a path an earlier rule
+// excluded. Blank lines and lines starting with "#" are ignored.
+func loadFilterFile(path string) []filterRule {
+	if path == "" {
+		return nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		logger.Error("can't read filter file", "filter_file", path, "error", err)
+		os.Exit(1)
+	}
+	defer file.Close()
+
+	var rules []filterRule
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		rule := filterRule{pattern: line}
+		if strings.HasPrefix(line, "!") {
+			rule.include = true
+			rule.pattern = strings.TrimPrefix(line, "!")
+		}
+		rules = append(rules, rule)
+	}
+
+	return rules
+}
+
+func matchGlob(pattern, path string) bool {
+	matched, err := filepath.Match(pattern, path)
+	return err == nil && matched
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBuildSelectFilterIncludeExclude(t *testing.T) {
+	origInclude, origExclude, origFilterFile := includePatterns, excludePatterns, *filterFile
+	t.Cleanup(func() {
+		includePatterns, excludePatterns = origInclude, origExclude
+		*filterFile = origFilterFile
+	})
+
+	includePatterns = stringList{"*.wsp"}
+	excludePatterns = stringList{"tmp_*"}
+	*filterFile = ""
+
+	filter := BuildSelectFilter()
+
+	if !filter("foo.wsp", fakeFileInfo{}) {
+		t.Error("expected foo.wsp to be included")
+	}
+	if filter("foo.txt", fakeFileInfo{}) {
+		t.Error("expected foo.txt to be excluded, it doesn't match -include")
+	}
+	if filter("tmp_foo.wsp", fakeFileInfo{}) {
+		t.Error("expected tmp_foo.wsp to be excluded by -exclude")
+	}
+	// A directory is never filtered by -include, only by -exclude, since
+	// pruning it would also hide wsp files underneath.
+	if !filter("sub", fakeFileInfo{dir: true}) {
+		t.Error("expected a directory not matching -include to still be walked into")
+	}
+}
+
+func TestBuildSelectFilterFileLastMatchWins(t *testing.T) {
+	origInclude, origExclude, origFilterFile := includePatterns, excludePatterns, *filterFile
+	t.Cleanup(func() {
+		includePatterns, excludePatterns = origInclude, origExclude
+		*filterFile = origFilterFile
+	})
+	includePatterns, excludePatterns = nil, nil
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "filters")
+	contents := "# comment\nsrv*.wsp\n!srv1.wsp\n"
+	if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	*filterFile = path
+
+	filter := BuildSelectFilter()
+
+	if filter("srv2.wsp", fakeFileInfo{}) {
+		t.Error("expected srv2.wsp to be excluded by the srv*.wsp rule")
+	}
+	if !filter("srv1.wsp", fakeFileInfo{}) {
+		t.Error("expected srv1.wsp to be re-included by the later !srv1.wsp rule")
+	}
+	if !filter("other.wsp", fakeFileInfo{}) {
+		t.Error("expected other.wsp to be kept, it matches no rule")
+	}
+}
+
+func TestLoadFilterFileMissing(t *testing.T) {
+	if rules := loadFilterFile(""); rules != nil {
+		t.Errorf("expected no rules for an empty path, got %v", rules)
+	}
+}
+
+func TestMatchGlob(t *testing.T) {
+	cases := []struct {
+		pattern, path string
+		want          bool
+	}{
+		{"*.wsp", "foo.wsp", true},
+		{"*.wsp", "foo.txt", false},
+		{"srv*.wsp", "srv1.wsp", true},
+	}
+	for _, c := range cases {
+		if got := matchGlob(c.pattern, c.path); got != c.want {
+			t.Errorf("matchGlob(%q, %q) = %v, want %v", c.pattern, c.path, got, c.want)
+		}
+	}
+}
+
+// fakeFileInfo is a minimal os.FileInfo stub for exercising SelectFilter
+// without touching the filesystem.
+type fakeFileInfo struct {
+	os.FileInfo
+	dir bool
+}
+
+func (f fakeFileInfo) IsDir() bool { return f.dir }
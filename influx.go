@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Flags controlling the direct-to-InfluxDB HTTP output backend. When
+// -influx-url is set, exported points are batched and POSTed straight to a
+// running InfluxDB instead of being written to local line protocol files.
+var (
+	influxURL           = flag.String("influx-url", "", "InfluxDB endpoint to write line protocol to directly (e.g. http://localhost:8086). Bypasses the file export path when set.")
+	influxUsername      = flag.String("username", "", "InfluxDB v1 username for basic auth.")
+	influxPassword      = flag.String("password", "", "InfluxDB v1 password for basic auth.")
+	influxToken         = flag.String("token", "", "InfluxDB v2 API token. Setting this (or -org) switches to the /api/v2/write endpoint.")
+	influxOrg           = flag.String("org", "", "InfluxDB v2 organization. Setting this (or -token) switches to the /api/v2/write endpoint.")
+	influxBatchSize     = flag.Int("batch-size", 5000, "Number of line protocol lines to accumulate per retention policy before writing to InfluxDB.")
+	influxFlushInterval = flag.Duration("flush-interval", 5*time.Second, "Maximum time a batch is held before being flushed, even if -batch-size hasn't been reached.")
+	influxRetries       = flag.Int("retries", 5, "Number of retries, with exponential backoff, on 5xx/429 InfluxDB responses.")
+)
+
+var influxClient = &http.Client{}
+
+// InfluxBatch accumulates line protocol lines for a single retention policy
+// and flushes them to InfluxDB once -batch-size is reached or
+// -flush-interval elapses.
+type InfluxBatch struct {
+	retention string
+	mu        sync.Mutex
+	lines     []string
+	timer     *time.Timer
+}
+
+var influxBatches = make(map[uint32]*InfluxBatch)
+
+// RetrieveInfluxBatch returns the batch for the given rate, creating it (and
+// arming its flush timer) on first use.
+func RetrieveInfluxBatch(rate uint32) *InfluxBatch {
+	batch, ok := influxBatches[rate]
+	if !ok {
+		batch = &InfluxBatch{retention: RetentionPolicyName(rate)}
+		batch.timer = time.AfterFunc(*influxFlushInterval, func() { batch.Flush() })
+		influxBatches[rate] = batch
+	}
+	return batch
+}
+
+// WriteLine appends a line protocol line to the batch, flushing it right
+// away if it just reached -batch-size.
+func (b *InfluxBatch) WriteLine(line string) {
+	b.mu.Lock()
+	b.lines = append(b.lines, line)
+	full := len(b.lines) >= *influxBatchSize
+	b.mu.Unlock()
+
+	if full {
+		b.Flush()
+	}
+}
+
+// Flush POSTs the accumulated lines to InfluxDB and empties the batch. It
+// is a no-op when the batch is empty, so it is safe to call from both the
+// flush timer and the final shutdown pass. The lines are claimed from the
+// batch up front so concurrent WriteLine calls keep accumulating into a
+// fresh batch rather than racing with the send; on failure the claimed
+// lines are put back in front of that batch and retried on the next
+// flush, instead of being dropped for good.
+func (b *InfluxBatch) Flush() error {
+	b.mu.Lock()
+	if len(b.lines) == 0 {
+		b.mu.Unlock()
+		return nil
+	}
+	lines := b.lines
+	b.lines = nil
+	b.mu.Unlock()
+
+	b.timer.Reset(*influxFlushInterval)
+
+	body := strings.Join(lines, "\n")
+	if err := postWithRetry(b.retention, body); err != nil {
+		logger.Error("error writing batch to influxdb, keeping it for retry", "retention", b.retention, "lines", len(lines), "error", err)
+		b.mu.Lock()
+		b.lines = append(lines, b.lines...)
+		b.mu.Unlock()
+		return err
+	}
+
+	logger.Debug("batch flushed", "retention", b.retention, "lines", len(lines))
+	return nil
+}
+
+// FlushAllInfluxBatches flushes every retention's batch, used on shutdown.
+func FlushAllInfluxBatches() {
+	for _, batch := range influxBatches {
+		batch.timer.Stop()
+		batch.Flush()
+	}
+}
+
+// HasPendingInfluxWrites reports whether any batch still holds lines that
+// were never successfully written, so the caller can fail loudly instead
+// of exiting 0 after silently losing data.
+func HasPendingInfluxWrites() bool {
+	for _, batch := range influxBatches {
+		batch.mu.Lock()
+		pending := len(batch.lines) > 0
+		batch.mu.Unlock()
+		if pending {
+			return true
+		}
+	}
+	return false
+}
+
+// postWithRetry sends one write request, gzip-encoding the body when -gz is
+// set, and retries with exponential backoff on 5xx/429 responses. 4xx
+// responses fail fast with the response body surfaced.
+func postWithRetry(retention, body string) error {
+	payload := []byte(body)
+	if *gzipped {
+		gzPayload, err := gzipBytes(payload)
+		if err != nil {
+			return err
+		}
+		payload = gzPayload
+	}
+
+	var lastErr error
+	for attempt := 0; attempt <= *influxRetries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(backoff(attempt))
+		}
+
+		req, err := newWriteRequest(retention, payload)
+		if err != nil {
+			return err
+		}
+
+		resp, err := influxClient.Do(req)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		respBody, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		switch {
+		case resp.StatusCode >= 200 && resp.StatusCode < 300:
+			return nil
+		case resp.StatusCode == 429 || resp.StatusCode >= 500:
+			lastErr = fmt.Errorf("influxdb returned %s: %s", resp.Status, string(respBody))
+		default:
+			return fmt.Errorf("influxdb rejected write (%s): %s", resp.Status, string(respBody))
+		}
+	}
+	return lastErr
+}
+
+// backoff returns the exponential delay before the given retry attempt.
+func backoff(attempt int) time.Duration {
+	return time.Duration(math.Pow(2, float64(attempt))) * 100 * time.Millisecond
+}
+
+// newWriteRequest builds the v1 /write or v2 /api/v2/write request for the
+// given retention policy, picking the variant based on whether -org/-token
+// were set.
+func newWriteRequest(retention string, payload []byte) (*http.Request, error) {
+	endpoint := strings.TrimRight(*influxURL, "/")
+	values := url.Values{}
+	values.Set("precision", "s")
+
+	if *influxOrg != "" || *influxToken != "" {
+		endpoint += "/api/v2/write"
+		values.Set("org", *influxOrg)
+		values.Set("bucket", *database+"/"+retention)
+	} else {
+		endpoint += "/write"
+		values.Set("db", *database)
+		values.Set("rp", retention)
+	}
+
+	req, err := http.NewRequest("POST", endpoint+"?"+values.Encode(), bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if *gzipped {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+
+	if *influxToken != "" {
+		req.Header.Set("Authorization", "Token "+*influxToken)
+	} else if *influxUsername != "" {
+		req.SetBasicAuth(*influxUsername, *influxPassword)
+	}
+
+	return req, nil
+}
+
+// gzipBytes gzip-encodes data in one shot, used for the InfluxDB HTTP batches.
+func gzipBytes(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if _, err := gz.Write(data); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// Flags controlling the structured logger. -log-format/-log-level/-log-file
+// configure a local text or JSON handler; -syslog instead ships records to a
+// syslog daemon.
+var (
+	logFormat  = flag.String("log-format", "text", "Log output format: text or json.")
+	logLevel   = flag.String("log-level", "info", "Minimum level to log: debug, info, warn or error.")
+	logFile    = flag.String("log-file", "", "Write logs to this file instead of stderr.")
+	syslogAddr = flag.String("syslog", "", "Send logs to a syslog daemon instead of a local file, e.g. tcp://host:514 or unix:/dev/log.")
+)
+
+// logger is the package-level structured logger used for every migration
+// event (file matched/skipped, archive read errors, points skipped,
+// batches flushed, ...). It is only safe to use after initLogger has run.
+var logger *slog.Logger
+
+// initLogger builds the package-level logger from -log-format, -log-level,
+// -log-file and -syslog. It must run after flag.Parse.
+func initLogger() {
+	level := parseLogLevel(*logLevel)
+	opts := &slog.HandlerOptions{Level: level}
+
+	var handler slog.Handler
+	if *syslogAddr != "" {
+		h, err := newSyslogHandler(*syslogAddr, level, *logFormat)
+		if err != nil {
+			fmt.Println("Can't connect to syslog:", err)
+			panic(err)
+		}
+		handler = h
+	} else if *logFormat == "json" {
+		handler = slog.NewJSONHandler(openLogFile(), opts)
+	} else {
+		handler = slog.NewTextHandler(openLogFile(), opts)
+	}
+
+	logger = slog.New(handler)
+}
+
+// parseLogLevel maps -log-level to a slog.Level, defaulting to info for an
+// unrecognized value.
+func parseLogLevel(s string) slog.Level {
+	switch strings.ToLower(s) {
+	case "debug":
+		return slog.LevelDebug
+	case "warn":
+		return slog.LevelWarn
+	case "error":
+		return slog.LevelError
+	default:
+		return slog.LevelInfo
+	}
+}
+
+// openLogFile returns -log-file, or stderr if it wasn't set.
+func openLogFile() *os.File {
+	if *logFile == "" {
+		return os.Stderr
+	}
+
+	f, err := os.OpenFile(*logFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		fmt.Println("Can't open log file:", *logFile)
+		panic(err)
+	}
+	return f
+}
@@ -0,0 +1,35 @@
+//go:build !windows
+
+package main
+
+import (
+	"log/slog"
+	"log/syslog"
+	"strings"
+)
+
+// newSyslogHandler dials the syslog daemon described by addr, e.g.
+// "tcp://host:514" or "unix:/dev/log", and wraps the connection in a
+// slog.Handler.
+func newSyslogHandler(addr string, level slog.Level, format string) (slog.Handler, error) {
+	network, raddr := parseSyslogAddr(addr)
+
+	writer, err := syslog.Dial(network, raddr, syslog.LOG_INFO|syslog.LOG_DAEMON, "whisper-line-protocol")
+	if err != nil {
+		return nil, err
+	}
+
+	opts := &slog.HandlerOptions{Level: level}
+	if format == "json" {
+		return slog.NewJSONHandler(writer, opts), nil
+	}
+	return slog.NewTextHandler(writer, opts), nil
+}
+
+// parseSyslogAddr splits "tcp://host:514" or "unix:/dev/log" into the
+// network and address syslog.Dial expects.
+func parseSyslogAddr(addr string) (network, raddr string) {
+	network, rest, _ := strings.Cut(addr, ":")
+	raddr = strings.TrimPrefix(rest, "//")
+	return network, raddr
+}
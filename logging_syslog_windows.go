@@ -0,0 +1,14 @@
+//go:build windows
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+)
+
+// newSyslogHandler is unavailable on Windows: log/syslog only dials Unix
+// targets.
+func newSyslogHandler(addr string, level slog.Level, format string) (slog.Handler, error) {
+	return nil, fmt.Errorf("-syslog is not supported on windows")
+}
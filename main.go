@@ -3,17 +3,16 @@ package main
 import (
 	"bufio"
 	"compress/gzip"
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"github.com/uttamgandhi24/whisper-go/whisper"
 	"io/ioutil"
-	"log"
-	"math"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"regexp"
-	"strconv"
 	"strings"
 )
 
@@ -35,6 +34,21 @@ type MigrationBuffer struct {
 	File      *os.File
 }
 
+// flush pushes the bufio (and, if set, gzip) buffers out to File and
+// fsyncs it, so a checkpoint recorded right after it returns can be
+// trusted even across an OOM kill or power loss.
+func (b MigrationBuffer) flush() error {
+	if err := b.Buffer.Flush(); err != nil {
+		return err
+	}
+	if b.GzBuffer != nil {
+		if err := b.GzBuffer.Flush(); err != nil {
+			return err
+		}
+	}
+	return b.File.Sync()
+}
+
 type TagKeyValue struct {
 	Tagkey   string `json:"tagkey"`
 	Tagvalue string `json:"tagvalue"`
@@ -62,21 +76,27 @@ var (
 	exportZeros    = flag.Bool("zeros", false, "Export null values (equal to zero). Those are ignored by default.")
 	database       = flag.String("database", "graphite" ,"Name of the influxdb database to use in export context.")
 	retentionsStr  = flag.String("retentions", "" ,"Coma-separated retention names to use in export context.")
+	workers        = flag.Int("workers", 4, "Number of concurrent export workers decoding whisper archives.")
 )
 
-var retentions []string
-
 func main() {
 	flag.Parse()
-	retentions = strings.Split(*retentionsStr, ",")
-
-	// List wsp files and figure out tags, measurements, file names, etc.
-	migrations := ListMigrations(*wspPath, *configFile)
+	initLogger()
 
 	// Time boundaries
 	var from uint32 = uint32(*fromFlag)
 	var until uint32 = uint32(*untilFlag)
 
+	// Resume/skip already-exported files according to -state-file
+	state := LoadState(*stateFilePath)
+
+	// List wsp files and figure out tags, measurements, file names, etc.
+	migrations := ListMigrations(*wspPath, *configFile, BuildSelectFilter(), from, until, state)
+
+	// Assign -retentions names to rates by sorted rate value, not by
+	// which rate a concurrent worker happens to observe first.
+	retentionNames = assignRetentionNames(migrations)
+
 	// Warning starting exporting
 	fmt.Println("----------------")
 	fmt.Println("Exporting", len(migrations), "series to", *exportPath)
@@ -85,17 +105,21 @@ func main() {
 	}
 	fmt.Println("----------------")
 
-	// Go through wsp files and export data
-	for k, migration := range migrations {
-		migration.export(from, until)
-
-		// Notify the file was exported
-		if *verbose {
-			fmt.Println("Exported:", migration.wspFile)
-		} else {
-			fmt.Printf("\rExported: %2d series", k + 1)
-		}
-	}
+	// Cancel the pipeline on SIGINT so partially-flushed buffers still get
+	// closed cleanly instead of being torn down mid-write.
+	ctx, cancel := context.WithCancel(context.Background())
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt)
+	go func() {
+		<-sigCh
+		logger.Warn("interrupted, flushing in-flight batches before exiting")
+		cancel()
+	}()
+
+	// Walk, decode and write the wsp files through a worker pool
+	encoder := SelectEncoder()
+	runExportPipeline(ctx, migrations, from, until, *workers, state, encoder)
+	signal.Stop(sigCh)
 	fmt.Println()
 
 	// Close all buffers
@@ -107,16 +131,85 @@ func main() {
 		}
 		buffer.File.Close()
 	}
+
+	// Flush whatever is left in the InfluxDB batches
+	FlushAllInfluxBatches()
+
+	// Flush whatever is left buffered by batching encoders (e.g. promrw)
+	var flushFailed bool
+	if flusher, ok := encoder.(interface{ Flush() error }); ok {
+		if err := flusher.Flush(); err != nil {
+			logger.Error("error flushing encoder", "error", err)
+			flushFailed = true
+		}
+	}
+
+	// Some points may still be sitting unflushed after retries were
+	// exhausted: fail loudly instead of exiting 0 on silent data loss.
+	if HasPendingInfluxWrites() || flushFailed {
+		logger.Error("some batches could not be flushed; points were not durably written")
+		os.Exit(1)
+	}
 }
 
 
 // Check errors
 func check(e error) {
 	if e != nil {
-		panic(e)
+		logger.Error("fatal error", "error", e)
+		os.Exit(1)
+	}
+}
+
+
+// sinkWriter is the per-rate output a sink goroutine drives. Flush must
+// make every prior Write durable enough that a checkpoint recorded right
+// after it returns can be trusted, even across an OOM kill or power loss.
+type sinkWriter interface {
+	Write(line string)
+	Flush() error
+}
+
+// sink resolves the writer for a given rate, picking the file-backed
+// MigrationBuffer or the InfluxDB HTTP batch depending on -influx-url. It
+// is only ever called from the sink dispatcher goroutine in pipeline.go,
+// which keeps the lazy map creation in RetrieveMigrationBuffer/
+// RetrieveInfluxBatch single-threaded.
+func sink(rate uint32) sinkWriter {
+	if *influxURL != "" {
+		return influxSinkWriter{batch: RetrieveInfluxBatch(rate)}
 	}
+	return fileSinkWriter{buffer: RetrieveMigrationBuffer(rate)}
+}
+
+// fileSinkWriter is the sinkWriter for file export. Flush pushes the
+// bufio/gzip buffers out and fsyncs the underlying file.
+type fileSinkWriter struct {
+	buffer MigrationBuffer
+}
+
+func (w fileSinkWriter) Write(line string) {
+	_, err := w.buffer.Buffer.WriteString(line)
+	check(err)
+}
+
+func (w fileSinkWriter) Flush() error {
+	return w.buffer.flush()
+}
+
+// influxSinkWriter is the sinkWriter for the direct-to-InfluxDB output.
+// Flush POSTs whatever has accumulated since the last flush.
+type influxSinkWriter struct {
+	batch *InfluxBatch
+}
+
+func (w influxSinkWriter) Write(line string) {
+	w.batch.WriteLine(line)
 }
 
+func (w influxSinkWriter) Flush() error {
+	return w.batch.Flush()
+}
 
 func RetrieveMigrationBuffer(rate uint32) MigrationBuffer {
 	buffer, ok := buffers[rate]
@@ -147,18 +240,19 @@ func RetrieveMigrationBuffer(rate uint32) MigrationBuffer {
 
 		buffers[rate] = buffer
 
-		// Write the context to the buffer
-		buffer.Buffer.WriteString(LineProtocolContext(*database, retention))
+		// The "# DML" context header is InfluxDB-specific, so only line
+		// protocol output carries it
+		if *outputEncoder != "graphite" {
+			buffer.Buffer.WriteString(LineProtocolContext(*database, retention))
+		}
 	}
 	return buffer
 }
 
 
 func RetentionPolicyName(rate uint32) string {
-	if len(retentions) > 0 {
-		var current string
-		current, retentions = retentions[0], retentions[1:]
-		return current
+	if name, ok := retentionNames[rate]; ok {
+		return name
 	}
 	return fmt.Sprintf("%d", rate)
 }
@@ -171,56 +265,15 @@ func LineProtocolContext(database, retention string) string {
 }
 
 
-// Export the series described in the migration object
-func (migration *MigrationData) export(from, until uint32) {
-	// Open whisper file with driver
-	w, err := whisper.Open(migration.wspFile)
-	if err != nil {
-		fmt.Println("\nError opening file:", err)
-		return
-	}
-
-	for i, archive := range w.Header.Archives {
-		// retrieve the buffer
-		buffer := RetrieveMigrationBuffer(archive.SecondsPerPoint)
-
-		// Go through points
-		points, err := w.DumpArchive(i)
-		if err != nil {
-			if *verbose {
-				fmt.Println("\nError reading:", migration.wspFile)
-			}
-			continue
-		}
-		for _, point := range points {
-			// Skip the point on certain conditions
-			if !*exportZeros && point.Value == 0 {
-				continue
-			}
-			if point.Timestamp < from || point.Timestamp > until {
-				continue
-			}
-
-			// Write the point to file
-			line := migration.lineprotocol(point, archive.SecondsPerPoint) + "\n"
-			_, err := buffer.Buffer.WriteString(line)
-			check(err)
-		}
-	}
-
-	w.Close()
-}
-
-
 // List all the migrations in a migration array
-func ListMigrations(wspPath, configFile string) []MigrationData {
+func ListMigrations(wspPath, configFile string, filter SelectFilter, from, until uint32, state *State) []MigrationData {
 	// List files
-	fileList := listWspFiles(wspPath)
+	fileList := listWspFiles(wspPath, filter)
 
 	// Open migration config file
 	config := LoadConfigFile(configFile)
 
-	fmt.Println("Checking files to export...")
+	logger.Info("checking files to export", "count", len(fileList))
 
 	var migrationData []MigrationData
 	for _, wspFile := range fileList {
@@ -240,11 +293,30 @@ func ListMigrations(wspPath, configFile string) []MigrationData {
 		// Assign the right measurment, field and tags
 		data.assignConfig(config)
 
-		if data.matched {
-			migrationData = append(migrationData, data)
-		} else if *verbose {
-			fmt.Println("File didn't match any config patterns: ", data.wspFile)
+		if !data.matched {
+			logger.Debug("file skipped: no matching config pattern", "wsp_file", data.wspFile)
+			continue
 		}
+
+		// Skip files every archive of which was already fully exported by
+		// a previous run. Partial or per-archive resume is handled in
+		// exportTo instead, since whisper's archives cover
+		// overlapping-but-independent time ranges and can be interrupted
+		// out of step with one another.
+		if !*forceExport {
+			if entry, ok := state.Get(data.wspFile, wholeFileArchiveIndex); ok && entry.LastTimestamp >= until {
+				if w, err := whisper.Open(data.wspFile); err == nil {
+					stale := headerSHA256(w.Header) != entry.HeaderSHA256
+					w.Close()
+					if !stale {
+						logger.Debug("file skipped: already exported through the requested window", "wsp_file", data.wspFile)
+						continue
+					}
+				}
+			}
+		}
+
+		migrationData = append(migrationData, data)
 	}
 
 	return migrationData
@@ -266,7 +338,8 @@ func askForConfirmation(s string) bool {
 
 		response, err := reader.ReadString('\n')
 		if err != nil {
-			log.Fatal(err)
+			logger.Error("can't read confirmation", "error", err)
+			os.Exit(1)
 		}
 
 		response = strings.ToLower(strings.TrimSpace(response))
@@ -288,7 +361,8 @@ func AskForText(s string) string {
 
 		response, err := reader.ReadString('\n')
 		if err != nil {
-			log.Fatal(err)
+			logger.Error("can't read answer", "error", err)
+			os.Exit(1)
 		}
 
 		response = strings.ToLower(strings.TrimSpace(response))
@@ -299,22 +373,35 @@ func AskForText(s string) string {
 
 
 // Create the list of wsp files
-func listWspFiles(searchDir string) []string {
+func listWspFiles(searchDir string, filter SelectFilter) []string {
 	var fileList []string
 
 	err := filepath.Walk(searchDir, func(path string, f os.FileInfo, err error) error {
 		if os.IsNotExist(err) { //search dir does not exist
 			return nil
 		}
+		if f == nil {
+			return nil
+		}
+
+		relPath := strings.TrimPrefix(strings.TrimPrefix(path, searchDir), "/")
+
+		// Prune the whole subtree before opening any wsp file underneath it
+		if filter != nil && !filter(relPath, f) {
+			if f.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
 		// Only add wsp files to the list
-		if strings.HasSuffix(f.Name(), "wsp") {
+		if !f.IsDir() && strings.HasSuffix(f.Name(), "wsp") {
 			fileList = append(fileList, path)
 		}
 		return nil
 	})
 	if err != nil {
-		fmt.Println("Error listing files:")
-		fmt.Println(err)
+		logger.Error("error listing wsp files", "wsp_path", searchDir, "error", err)
 	}
 
 	return fileList
@@ -327,33 +414,20 @@ func LoadConfigFile(filename string) []MigrationConfig {
 
 	raw, err := ioutil.ReadFile(filename)
 	if err != nil {
-		fmt.Println("Can't read config file:", filename)
-		panic(err)
+		logger.Error("can't read config file", "config_file", filename, "error", err)
+		os.Exit(1)
 	}
-	
+
 	err = json.Unmarshal(raw, &migrationConfig)
 	if err != nil {
-		fmt.Println("Can't unmarshal config file json:")
-		panic(err)
+		logger.Error("can't unmarshal config file json", "config_file", filename, "error", err)
+		os.Exit(1)
 	}
 
 	return migrationConfig
 }
 
 
-// Generate the influxdb line protocol string for a given point
-func (migrationData *MigrationData) lineprotocol(point whisper.Point, factor uint32) string {
-	var line string
-	line += migrationData.measurement
-	line += migrationData.tags
-	line += " "
-	line += migrationData.field + "=" + strconv.FormatFloat(math.Ceil(point.Value * float64(factor)), 'f', -1, 64)
-	line += " "
-	line += strconv.FormatInt(int64(point.Timestamp), 10)
-	return line
-}
-
-
 // Get measurement, tags and field by matching the whisper filename with a
 // pattern in the config file
 // This part is inspired by the project https://github.com/influxdata/whisper-migrator
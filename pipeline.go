@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/uttamgandhi24/whisper-go/whisper"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// lineResult is one line-protocol string produced by an export worker,
+// tagged with the retention rate it belongs to so it can be routed to the
+// right sink. ack, if set, asks the sink to flush everything written for
+// that rate so far (this line included, if any) and report back whether
+// the flush succeeded, so a checkpoint is only persisted once the data it
+// covers is actually durable.
+type lineResult struct {
+	rate uint32
+	line string
+	ack  chan<- error
+}
+
+// runExportPipeline walks the given migrations through a producer/consumer
+// pipeline: a walker goroutine feeds jobs to N export workers, each of
+// which opens its own whisper file and decodes archives, emitting
+// lineResults on a shared channel. Those results are then fanned out to
+// one sink goroutine per rate. The pipeline drains and returns as soon as
+// ctx is cancelled or every job has been processed.
+func runExportPipeline(ctx context.Context, migrations []MigrationData, from, until uint32, workers int, state *State, encoder Encoder) {
+	jobs := make(chan MigrationData)
+	results := make(chan lineResult)
+
+	// Walker: feed jobs to the workers, stopping early on cancellation.
+	go func() {
+		defer close(jobs)
+		for _, migration := range migrations {
+			select {
+			case jobs <- migration:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	sinksDone := startSinks(results)
+
+	// Workers: decode archives and turn points into line protocol results.
+	var wg sync.WaitGroup
+	var exported int64
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for migration := range jobs {
+				migration.exportTo(ctx, from, until, results, state, encoder)
+				reportProgress(atomic.AddInt64(&exported, 1), len(migrations), migration)
+			}
+		}()
+	}
+
+	wg.Wait()
+	close(results)
+	<-sinksDone
+}
+
+// reportProgress prints a per-file notice in verbose mode, or an
+// aggregated counter otherwise. It is called concurrently by every worker,
+// so the counter itself is updated atomically by the caller.
+func reportProgress(exported int64, total int, migration MigrationData) {
+	if *verbose {
+		fmt.Println("Exported:", migration.wspFile)
+	} else {
+		fmt.Printf("\rExported: %2d/%d series", exported, total)
+	}
+}
+
+// sinkMsg is one unit of work handed to a per-rate sink goroutine: a line
+// to write and/or a request to flush and report back durability.
+type sinkMsg struct {
+	line string
+	ack  chan<- error
+}
+
+// startSinks consumes lineResults and fans them out to one goroutine per
+// rate, each the sole writer for its MigrationBuffer or InfluxBatch. The
+// returned channel is closed once every sink has drained and finished.
+func startSinks(results <-chan lineResult) <-chan struct{} {
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		var wg sync.WaitGroup
+		channels := make(map[uint32]chan sinkMsg)
+
+		for res := range results {
+			ch, ok := channels[res.rate]
+			if !ok {
+				ch = make(chan sinkMsg, 1024)
+				channels[res.rate] = ch
+				writer := sink(res.rate)
+
+				wg.Add(1)
+				go func(msgs <-chan sinkMsg) {
+					defer wg.Done()
+					for msg := range msgs {
+						if msg.line != "" {
+							writer.Write(msg.line)
+						}
+						if msg.ack != nil {
+							msg.ack <- writer.Flush()
+						}
+					}
+				}(ch)
+			}
+			ch <- sinkMsg{line: res.line, ack: res.ack}
+		}
+
+		for _, ch := range channels {
+			close(ch)
+		}
+		wg.Wait()
+	}()
+
+	return done
+}
+
+// exportTo reads the whisper archives for the migration and sends the
+// resulting line protocol strings on results instead of writing them
+// directly, so that a single sink goroutine per rate remains the only
+// writer to its buffer. Each archive is resumed and checkpointed
+// independently against state, since whisper's archives cover
+// overlapping-but-independent time ranges and can be interrupted out of
+// step with one another. A checkpoint is only persisted once the data
+// behind it was durably flushed, so a hard interruption between an
+// enqueue and the final buffer flush can never advance state past what
+// was actually written. Encoders that batch and ship requests directly
+// instead of returning a line (e.g. promrw) never reach the per-rate
+// sinks at all, so their own Flush is used to confirm durability instead.
+func (migration *MigrationData) exportTo(ctx context.Context, from, until uint32, results chan<- lineResult, state *State, encoder Encoder) {
+	w, err := whisper.Open(migration.wspFile)
+	if err != nil {
+		logger.Error("error opening whisper file", "wsp_file", migration.wspFile, "error", err)
+		return
+	}
+	defer w.Close()
+
+	headerHash := headerSHA256(w.Header)
+	allCheckpointed := true
+	flusher, _ := encoder.(interface{ Flush() error })
+
+	for i, archive := range w.Header.Archives {
+		if ctx.Err() != nil {
+			break
+		}
+
+		archiveFrom := from
+		if !*forceExport {
+			if entry, ok := state.Get(migration.wspFile, i); ok && entry.HeaderSHA256 == headerHash {
+				if entry.LastTimestamp >= until {
+					continue
+				}
+				if entry.LastTimestamp+1 > archiveFrom {
+					archiveFrom = entry.LastTimestamp + 1
+				}
+			}
+		}
+
+		points, err := w.DumpArchive(i)
+		if err != nil {
+			logger.Warn("error reading archive", "wsp_file", migration.wspFile, "rate", archive.SecondsPerPoint, "error", err)
+			continue
+		}
+
+		var lastTimestamp uint32
+		var dirty bool
+		lastCheckpoint := time.Now()
+		checkpoint := func() {
+			if !dirty {
+				return
+			}
+
+			if flusher != nil {
+				// This encoder bypasses the line-based sinks entirely, so
+				// there is no per-rate sink to ack through: confirm
+				// durability via the encoder's own Flush instead.
+				if err := flusher.Flush(); err != nil {
+					logger.Warn("checkpoint skipped: encoder flush failed", "wsp_file", migration.wspFile, "rate", archive.SecondsPerPoint, "error", err)
+					allCheckpointed = false
+					return
+				}
+			} else {
+				ack := make(chan error, 1)
+				select {
+				case results <- lineResult{rate: archive.SecondsPerPoint, ack: ack}:
+				case <-ctx.Done():
+					allCheckpointed = false
+					return
+				}
+				if err := <-ack; err != nil {
+					logger.Warn("checkpoint skipped: sink flush failed", "wsp_file", migration.wspFile, "rate", archive.SecondsPerPoint, "error", err)
+					allCheckpointed = false
+					return
+				}
+			}
+
+			state.Update(StateEntry{
+				WspFile:       migration.wspFile,
+				HeaderSHA256:  headerHash,
+				ArchiveIndex:  i,
+				LastTimestamp: lastTimestamp,
+			})
+			dirty = false
+		}
+
+		for _, point := range points {
+			// Skip the point on certain conditions
+			if !*exportZeros && point.Value == 0 {
+				continue
+			}
+			if point.Timestamp < archiveFrom || point.Timestamp > until {
+				continue
+			}
+
+			line := encoder.Encode(migration, point, archive.SecondsPerPoint)
+			if line != "" {
+				select {
+				case results <- lineResult{rate: archive.SecondsPerPoint, line: line + "\n"}:
+				case <-ctx.Done():
+					checkpoint()
+					return
+				}
+			}
+
+			if point.Timestamp > lastTimestamp {
+				lastTimestamp = point.Timestamp
+			}
+			dirty = true
+			if *checkpointInterval > 0 && time.Since(lastCheckpoint) >= *checkpointInterval {
+				checkpoint()
+				lastCheckpoint = time.Now()
+			}
+		}
+
+		checkpoint()
+	}
+
+	// Once every archive has been checkpointed durably, record a
+	// whole-file watermark so ListMigrations can skip this file outright
+	// on the next run without opening it.
+	if allCheckpointed && ctx.Err() == nil {
+		state.Update(StateEntry{
+			WspFile:       migration.wspFile,
+			HeaderSHA256:  headerHash,
+			ArchiveIndex:  wholeFileArchiveIndex,
+			LastTimestamp: until,
+		})
+	}
+}
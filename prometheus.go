@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/uttamgandhi24/whisper-go/whisper"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// Flags for the Prometheus remote_write encoder, used when -output=promrw.
+var (
+	remoteWriteURL    = flag.String("remote-write-url", "", "Prometheus remote_write endpoint to POST samples to.")
+	remoteWriteTenant = flag.String("remote-write-tenant", "", "Value sent as the X-Scope-OrgID header, for multi-tenant remote_write receivers.")
+	remoteWriteAuth   = flag.String("remote-write-auth", "", "Bearer token sent as the Authorization header for the remote_write endpoint.")
+)
+
+var (
+	metricNameInvalidChars = regexp.MustCompile(`[^a-zA-Z0-9_:]`)
+	metricNameInvalidLead  = regexp.MustCompile(`^[^a-zA-Z_:]`)
+)
+
+// sanitizeMetricName makes a string safe to use as a Prometheus metric or
+// label name: [a-zA-Z_:][a-zA-Z0-9_:]*.
+func sanitizeMetricName(name string) string {
+	name = metricNameInvalidChars.ReplaceAllString(name, "_")
+	if metricNameInvalidLead.MatchString(name) {
+		name = "_" + name
+	}
+	return name
+}
+
+// PrometheusRemoteWriteEncoder translates points into prompb samples,
+// batches them into a prompb.WriteRequest and snappy-compresses/POSTs it
+// to -remote-write-url once -batch-size samples have accumulated. It
+// bypasses the line-based sink path entirely, so Encode always returns "".
+type PrometheusRemoteWriteEncoder struct {
+	mu     sync.Mutex
+	series []prompb.TimeSeries
+}
+
+func (e *PrometheusRemoteWriteEncoder) Encode(migration *MigrationData, point whisper.Point, rate uint32) string {
+	labels := []prompb.Label{
+		{Name: "__name__", Value: sanitizeMetricName(migration.measurement + "_" + migration.field)},
+	}
+	for _, pair := range strings.Split(strings.TrimPrefix(migration.tags, ","), ",") {
+		if pair == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		labels = append(labels, prompb.Label{Name: sanitizeMetricName(kv[0]), Value: kv[1]})
+	}
+
+	series := prompb.TimeSeries{
+		Labels:  labels,
+		Samples: []prompb.Sample{{Value: point.Value, Timestamp: int64(point.Timestamp) * 1000}},
+	}
+
+	e.mu.Lock()
+	e.series = append(e.series, series)
+	full := len(e.series) >= *influxBatchSize
+	e.mu.Unlock()
+
+	if full {
+		if err := e.Flush(); err != nil {
+			logger.Error("error writing batch to remote_write endpoint", "error", err)
+		}
+	}
+
+	return ""
+}
+
+// Flush POSTs whatever samples have accumulated since the last flush. It
+// is a no-op when nothing is buffered, so it is safe to call again on
+// shutdown to drain a partial batch.
+func (e *PrometheusRemoteWriteEncoder) Flush() error {
+	e.mu.Lock()
+	if len(e.series) == 0 {
+		e.mu.Unlock()
+		return nil
+	}
+	series := e.series
+	e.series = nil
+	e.mu.Unlock()
+
+	raw, err := (&prompb.WriteRequest{Timeseries: series}).Marshal()
+	if err != nil {
+		return err
+	}
+	compressed := snappy.Encode(nil, raw)
+
+	req, err := http.NewRequest("POST", *remoteWriteURL, bytes.NewReader(compressed))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	if *remoteWriteTenant != "" {
+		req.Header.Set("X-Scope-OrgID", *remoteWriteTenant)
+	}
+	if *remoteWriteAuth != "" {
+		req.Header.Set("Authorization", "Bearer "+*remoteWriteAuth)
+	}
+
+	resp, err := influxClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("remote_write endpoint returned %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"github.com/uttamgandhi24/whisper-go/whisper"
+	"sort"
+	"strings"
+)
+
+// retentionNames maps a discovered retention rate to the name given in
+// -retentions. It is built once by assignRetentionNames before the export
+// pipeline starts, so lookups in RetentionPolicyName never race.
+var retentionNames map[uint32]string
+
+// assignRetentionNames maps the retention rates found across migrations to
+// the names given in -retentions, in ascending rate order. Names must be
+// assigned by sorted rate rather than by which rate a worker happens to
+// observe first: runExportPipeline processes migrations across concurrent
+// workers funneling onto a shared results channel, so "first observed"
+// order is a goroutine-scheduling race, not a stable property of the wsp
+// tree. It is a no-op when -retentions wasn't set.
+func assignRetentionNames(migrations []MigrationData) map[uint32]string {
+	if *retentionsStr == "" {
+		return nil
+	}
+
+	rateSet := make(map[uint32]struct{})
+	for _, migration := range migrations {
+		w, err := whisper.Open(migration.wspFile)
+		if err != nil {
+			continue
+		}
+		for _, archive := range w.Header.Archives {
+			rateSet[archive.SecondsPerPoint] = struct{}{}
+		}
+		w.Close()
+	}
+
+	rates := make([]uint32, 0, len(rateSet))
+	for rate := range rateSet {
+		rates = append(rates, rate)
+	}
+	sort.Slice(rates, func(i, j int) bool { return rates[i] < rates[j] })
+
+	names := strings.Split(*retentionsStr, ",")
+	assigned := make(map[uint32]string, len(rates))
+	for i, rate := range rates {
+		if i >= len(names) {
+			break
+		}
+		assigned[rate] = names[i]
+	}
+	return assigned
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Flags controlling resumable export. -state-file turns a one-shot export
+// into a re-runnable job by recording per-wsp-file progress; -force bypasses
+// it; -checkpoint-interval bounds how much of a single large wsp file is
+// lost if the run is interrupted mid-file.
+var (
+	stateFilePath      = flag.String("state-file", "", "Path to a JSON checkpoint file used to skip or resume already-exported wsp files on the next run.")
+	forceExport        = flag.Bool("force", false, "Ignore -state-file and re-export every file from scratch.")
+	checkpointInterval = flag.Duration("checkpoint-interval", 30*time.Second, "How often progress on a wsp file being exported is flushed to -state-file mid-file.")
+)
+
+// StateEntry records how far a given archive of a wsp file has been
+// exported, so a later run can skip it if already covered by the
+// requested window or resume it if it was interrupted mid-archive.
+// Whisper's archives cover overlapping-but-independent time ranges, so
+// progress is tracked per archive rather than per file.
+type StateEntry struct {
+	WspFile       string `json:"wsp_file"`
+	HeaderSHA256  string `json:"header_sha256"`
+	ArchiveIndex  int    `json:"archive_index"`
+	LastTimestamp uint32 `json:"last_timestamp"`
+}
+
+// wholeFileArchiveIndex is the StateEntry.ArchiveIndex sentinel written
+// once every archive of a wsp file has been checkpointed, so ListMigrations
+// can skip the whole file on the next run without opening every archive.
+const wholeFileArchiveIndex = -1
+
+// State is the JSON-serialized export checkpoint, keyed by wsp file path
+// and archive index.
+type State struct {
+	path    string
+	mu      sync.Mutex
+	entries map[string]map[int]StateEntry
+}
+
+// LoadState reads the checkpoint at path, returning an empty state if path
+// is unset, -force was given, or the file doesn't exist yet. -force skips
+// reading it entirely, so a prior run's truncated or corrupt state file
+// can never stop a forced re-export from starting; Update rewrites it
+// from scratch as the new run makes progress.
+func LoadState(path string) *State {
+	state := &State{path: path, entries: make(map[string]map[int]StateEntry)}
+	if path == "" || *forceExport {
+		return state
+	}
+
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return state
+		}
+		logger.Error("can't read state file", "state_file", path, "error", err)
+		os.Exit(1)
+	}
+
+	var entries []StateEntry
+	if err := json.Unmarshal(raw, &entries); err != nil {
+		logger.Error("can't unmarshal state file", "state_file", path, "error", err)
+		os.Exit(1)
+	}
+	for _, entry := range entries {
+		state.put(entry)
+	}
+
+	return state
+}
+
+// Get returns the recorded progress for one archive of a wsp file, if any.
+func (s *State) Get(wspFile string, archiveIndex int) (StateEntry, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, ok := s.entries[wspFile][archiveIndex]
+	return entry, ok
+}
+
+// put records entry without persisting, the caller's responsibility. The
+// caller must hold s.mu, except when called from LoadState before the
+// State is shared.
+func (s *State) put(entry StateEntry) {
+	if s.entries[entry.WspFile] == nil {
+		s.entries[entry.WspFile] = make(map[int]StateEntry)
+	}
+	s.entries[entry.WspFile][entry.ArchiveIndex] = entry
+}
+
+// Update records progress for one archive of a wsp file and persists the
+// whole state file. It is a no-op when no -state-file was given.
+func (s *State) Update(entry StateEntry) {
+	if s.path == "" {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.put(entry)
+	var entries []StateEntry
+	for _, archives := range s.entries {
+		for _, e := range archives {
+			entries = append(entries, e)
+		}
+	}
+
+	raw, err := json.Marshal(entries)
+	if err != nil {
+		logger.Error("can't marshal state", "error", err)
+		return
+	}
+
+	if err := writeFileAtomic(s.path, raw); err != nil {
+		logger.Error("can't write state file", "state_file", s.path, "error", err)
+	}
+}
+
+// writeFileAtomic writes data to a temp file alongside path and renames it
+// into place, so a process killed mid-write can never leave path
+// truncated or corrupt.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+	defer os.Remove(tmpPath)
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, path)
+}
+
+// headerSHA256 hashes the JSON encoding of a whisper header, used to
+// detect when a wsp file was rewritten (rotated, resized, ...) since the
+// last recorded checkpoint: ListMigrations and exportTo both compare it
+// against the live header and ignore the checkpoint on a mismatch, rather
+// than trusting a stale one.
+func headerSHA256(header interface{}) string {
+	raw, err := json.Marshal(header)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(raw)
+	return fmt.Sprintf("%x", sum)
+}
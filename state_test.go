@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadStateMissingFile(t *testing.T) {
+	state := LoadState(filepath.Join(t.TempDir(), "does-not-exist.json"))
+	if _, ok := state.Get("foo.wsp", 0); ok {
+		t.Error("expected no entries for a checkpoint file that doesn't exist yet")
+	}
+}
+
+func TestLoadStateForceSkipsRead(t *testing.T) {
+	origForce := *forceExport
+	t.Cleanup(func() { *forceExport = origForce })
+
+	path := filepath.Join(t.TempDir(), "state.json")
+	if err := os.WriteFile(path, []byte("not valid json"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	*forceExport = true
+	state := LoadState(path)
+	if _, ok := state.Get("foo.wsp", 0); ok {
+		t.Error("expected -force to skip loading the (corrupt) state file entirely")
+	}
+}
+
+func TestStateUpdateAndGet(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	state := LoadState(path)
+
+	entry := StateEntry{WspFile: "foo.wsp", HeaderSHA256: "abc", ArchiveIndex: 0, LastTimestamp: 42}
+	state.Update(entry)
+
+	got, ok := state.Get("foo.wsp", 0)
+	if !ok {
+		t.Fatal("expected an entry for the archive just updated")
+	}
+	if got != entry {
+		t.Errorf("got %+v, want %+v", got, entry)
+	}
+
+	// A fresh LoadState against the same path should see it too.
+	reloaded := LoadState(path)
+	got, ok = reloaded.Get("foo.wsp", 0)
+	if !ok || got != entry {
+		t.Errorf("reloaded state = %+v, %v, want %+v, true", got, ok, entry)
+	}
+}
+
+func TestStateUpdateNoStateFileIsNoop(t *testing.T) {
+	state := LoadState("")
+	state.Update(StateEntry{WspFile: "foo.wsp", ArchiveIndex: 0, LastTimestamp: 1})
+	if _, ok := state.Get("foo.wsp", 0); ok {
+		t.Error("expected Update to do nothing when no -state-file was given")
+	}
+}
+
+func TestWriteFileAtomicLeavesNoTempFileBehind(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "state.json")
+
+	if err := writeFileAtomic(path, []byte(`[]`)); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "state.json" {
+		t.Errorf("expected only state.json in %s, got %v", dir, entries)
+	}
+}
+
+func TestHeaderSHA256DetectsChange(t *testing.T) {
+	h1 := headerSHA256(map[string]int{"a": 1})
+	h2 := headerSHA256(map[string]int{"a": 2})
+	if h1 == h2 {
+		t.Error("expected different headers to hash differently")
+	}
+	if h1 != headerSHA256(map[string]int{"a": 1}) {
+		t.Error("expected the same header to hash the same way every time")
+	}
+}
+
+func TestStateUpdatePersistsAcrossReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	state := LoadState(path)
+	state.Update(StateEntry{WspFile: "foo.wsp", HeaderSHA256: "h1", ArchiveIndex: wholeFileArchiveIndex, LastTimestamp: 100})
+
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entries []StateEntry
+	if err := json.Unmarshal(raw, &entries); err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].ArchiveIndex != wholeFileArchiveIndex {
+		t.Errorf("unexpected entries on disk: %+v", entries)
+	}
+}